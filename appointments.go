@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AppointmentStatus is the lifecycle state of an Appointment.
+type AppointmentStatus string
+
+const (
+	AppointmentPending   AppointmentStatus = "pending"
+	AppointmentConfirmed AppointmentStatus = "confirmed"
+	AppointmentCancelled AppointmentStatus = "cancelled"
+)
+
+type Appointment struct {
+	ID        int               `json:"id" gorm:"primaryKey"`
+	PatientID int               `json:"patient_id"`
+	DoctorID  int               `json:"doctor_id"`
+	Start     time.Time         `json:"start"`
+	End       time.Time         `json:"end"`
+	Status    AppointmentStatus `json:"status"`
+	Reason    string            `json:"reason"`
+	Notes     string            `json:"notes,omitempty"`
+}
+
+// TimeSlot is a free, bookable window for a doctor.
+type TimeSlot struct {
+	DoctorID int       `json:"doctor_id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// WeeklyAvailability describes one recurring working block, e.g. Monday 09:00-17:00.
+type WeeklyAvailability struct {
+	Weekday  time.Weekday `json:"weekday"`
+	StartMin int          `json:"start_min"` // minutes after midnight
+	EndMin   int          `json:"end_min"`
+}
+
+// AvailabilityException overrides the weekly pattern for a single calendar date,
+// either blocking it out entirely or replacing the working hours for that day.
+type AvailabilityException struct {
+	Date      string `json:"date"` // YYYY-MM-DD
+	Available bool   `json:"available"`
+	StartMin  int    `json:"start_min,omitempty"`
+	EndMin    int    `json:"end_min,omitempty"`
+}
+
+// DoctorSchedule is a doctor's recurring availability plus any one-off exceptions.
+type DoctorSchedule struct {
+	DoctorID    int                     `json:"doctor_id"`
+	SlotMinutes int                     `json:"slot_minutes"`
+	Weekly      []WeeklyAvailability    `json:"weekly"`
+	Exceptions  []AvailabilityException `json:"exceptions"`
+}
+
+func (s *MemoryRepository) SetSchedule(doctorID int, sched DoctorSchedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.doctors[doctorID]; !ok {
+		return errors.New("doctor not found")
+	}
+	if sched.SlotMinutes <= 0 {
+		sched.SlotMinutes = 30
+	}
+	sched.DoctorID = doctorID
+	s.schedules[doctorID] = sched
+	return nil
+}
+
+// FreeSlots computes bookable slots for doctorID in [from, to) by walking the
+// doctor's weekly availability, applying exceptions, and subtracting any
+// appointment that isn't cancelled.
+func (s *MemoryRepository) FreeSlots(doctorID int, from, to time.Time) ([]TimeSlot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.doctors[doctorID]; !ok {
+		return nil, errors.New("doctor not found")
+	}
+	sched, ok := s.schedules[doctorID]
+	if !ok {
+		return nil, nil
+	}
+	exceptions := map[string]AvailabilityException{}
+	for _, e := range sched.Exceptions {
+		exceptions[e.Date] = e
+	}
+
+	var slots []TimeSlot
+	for day := from.Truncate(24 * time.Hour); day.Before(to); day = day.AddDate(0, 0, 1) {
+		dateKey := day.Format("2006-01-02")
+		var windows []AvailabilityException
+		if ex, ok := exceptions[dateKey]; ok {
+			if !ex.Available {
+				continue
+			}
+			windows = append(windows, ex)
+		} else {
+			for _, w := range sched.Weekly {
+				if w.Weekday == day.Weekday() {
+					windows = append(windows, AvailabilityException{StartMin: w.StartMin, EndMin: w.EndMin})
+				}
+			}
+		}
+		for _, w := range windows {
+			slotStart := day.Add(time.Duration(w.StartMin) * time.Minute)
+			windowEnd := day.Add(time.Duration(w.EndMin) * time.Minute)
+			step := time.Duration(sched.SlotMinutes) * time.Minute
+			for slotStart.Add(step).Compare(windowEnd) <= 0 {
+				slotEnd := slotStart.Add(step)
+				if !slotStart.Before(from) && !slotEnd.After(to) && !s.hasConflictLocked(doctorID, slotStart, slotEnd, 0) {
+					slots = append(slots, TimeSlot{DoctorID: doctorID, Start: slotStart, End: slotEnd})
+				}
+				slotStart = slotEnd
+			}
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Start.Before(slots[j].Start) })
+	return slots, nil
+}
+
+// scheduleAllowsLocked reports whether [start, end) falls entirely within one
+// of doctorID's available windows for that calendar day, applying exceptions
+// the same way FreeSlots does. It does not check for conflicting
+// appointments; callers combine it with hasConflictLocked. Callers must hold
+// s.mu.
+func (s *MemoryRepository) scheduleAllowsLocked(doctorID int, start, end time.Time) bool {
+	sched, ok := s.schedules[doctorID]
+	if !ok {
+		return false
+	}
+	day := start.Truncate(24 * time.Hour)
+	var windows []AvailabilityException
+	if ex, ok := findException(sched.Exceptions, day); ok {
+		if !ex.Available {
+			return false
+		}
+		windows = append(windows, ex)
+	} else {
+		for _, w := range sched.Weekly {
+			if w.Weekday == day.Weekday() {
+				windows = append(windows, AvailabilityException{StartMin: w.StartMin, EndMin: w.EndMin})
+			}
+		}
+	}
+	for _, w := range windows {
+		winStart := day.Add(time.Duration(w.StartMin) * time.Minute)
+		winEnd := day.Add(time.Duration(w.EndMin) * time.Minute)
+		if !start.Before(winStart) && !end.After(winEnd) {
+			return true
+		}
+	}
+	return false
+}
+
+// findException returns the AvailabilityException (if any) overriding day.
+func findException(exceptions []AvailabilityException, day time.Time) (AvailabilityException, bool) {
+	dateKey := day.Format("2006-01-02")
+	for _, e := range exceptions {
+		if e.Date == dateKey {
+			return e, true
+		}
+	}
+	return AvailabilityException{}, false
+}
+
+// hasConflictLocked reports whether doctorID already has a non-cancelled
+// appointment overlapping [start, end), ignoring excludeID (used on reschedule).
+// Callers must hold s.mu.
+func (s *MemoryRepository) hasConflictLocked(doctorID int, start, end time.Time, excludeID int) bool {
+	for _, a := range s.appointments {
+		if a.DoctorID != doctorID || a.ID == excludeID || a.Status == AppointmentCancelled {
+			continue
+		}
+		if start.Before(a.End) && a.Start.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryRepository) BookAppointment(patientID, doctorID int, start, end time.Time, reason string) (Appointment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.patients[patientID]; !ok {
+		return Appointment{}, errors.New("patient not found")
+	}
+	if _, ok := s.doctors[doctorID]; !ok {
+		return Appointment{}, errors.New("doctor not found")
+	}
+	if !end.After(start) {
+		return Appointment{}, errors.New("end must be after start")
+	}
+	if !s.scheduleAllowsLocked(doctorID, start, end) {
+		return Appointment{}, errors.New("requested time is outside doctor's availability")
+	}
+	if s.hasConflictLocked(doctorID, start, end, 0) {
+		return Appointment{}, errors.New("slot no longer available")
+	}
+	s.nextApptID++
+	appt := Appointment{
+		ID:        s.nextApptID,
+		PatientID: patientID,
+		DoctorID:  doctorID,
+		Start:     start,
+		End:       end,
+		Status:    AppointmentPending,
+		Reason:    reason,
+	}
+	s.appointments[appt.ID] = appt
+	triggerPersist(s.appointmentsDirty)
+	s.notifyAppointment(patientID, doctorID)
+	return appt, nil
+}
+
+func (s *MemoryRepository) CancelAppointment(callerRole string, callerID, id int) (Appointment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	appt, ok := s.appointments[id]
+	if !ok {
+		return Appointment{}, errors.New("appointment not found")
+	}
+	if !appointmentOwnedBy(appt, callerRole, callerID) {
+		return Appointment{}, ErrForbidden
+	}
+	appt.Status = AppointmentCancelled
+	s.appointments[id] = appt
+	triggerPersist(s.appointmentsDirty)
+	s.notifyAppointment(appt.PatientID, appt.DoctorID)
+	return appt, nil
+}
+
+func (s *MemoryRepository) RescheduleAppointment(callerRole string, callerID, id int, start, end time.Time) (Appointment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	appt, ok := s.appointments[id]
+	if !ok {
+		return Appointment{}, errors.New("appointment not found")
+	}
+	if !appointmentOwnedBy(appt, callerRole, callerID) {
+		return Appointment{}, ErrForbidden
+	}
+	if appt.Status == AppointmentCancelled {
+		return Appointment{}, errors.New("appointment is cancelled")
+	}
+	if !end.After(start) {
+		return Appointment{}, errors.New("end must be after start")
+	}
+	if !s.scheduleAllowsLocked(appt.DoctorID, start, end) {
+		return Appointment{}, errors.New("requested time is outside doctor's availability")
+	}
+	if s.hasConflictLocked(appt.DoctorID, start, end, appt.ID) {
+		return Appointment{}, errors.New("slot no longer available")
+	}
+	appt.Start = start
+	appt.End = end
+	appt.Status = AppointmentPending
+	s.appointments[id] = appt
+	triggerPersist(s.appointmentsDirty)
+	s.notifyAppointment(appt.PatientID, appt.DoctorID)
+	return appt, nil
+}
+
+// ErrForbidden is returned by CancelAppointment/RescheduleAppointment when
+// the caller is neither the appointment's patient nor its doctor.
+var ErrForbidden = errors.New("forbidden")
+
+// appointmentOwnedBy reports whether callerRole/callerID is one of the two
+// parties to appt.
+func appointmentOwnedBy(appt Appointment, callerRole string, callerID int) bool {
+	switch callerRole {
+	case "patient":
+		return appt.PatientID == callerID
+	case "doctor":
+		return appt.DoctorID == callerID
+	default:
+		return false
+	}
+}
+
+// notifyAppointment pushes an "update" event to both sides of an
+// appointment so either party's open WebSocket refetches.
+func (s *MemoryRepository) notifyAppointment(patientID, doctorID int) {
+	s.pubsub.Publish(userKey{"patient", patientID}, Event{Type: EventUpdate})
+	s.pubsub.Publish(userKey{"doctor", doctorID}, Event{Type: EventUpdate})
+}
+
+func (s *MemoryRepository) AppointmentsOfPatient(patientID int) []Appointment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Appointment
+	for _, a := range s.appointments {
+		if a.PatientID == patientID {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+func (s *MemoryRepository) loadAppointments() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := os.ReadFile(s.appointmentFile)
+	if err != nil {
+		return err
+	}
+	var arr []Appointment
+	if err := json.Unmarshal(b, &arr); err != nil {
+		return err
+	}
+	for _, a := range arr {
+		s.appointments[a.ID] = a
+		if a.ID > s.nextApptID {
+			s.nextApptID = a.ID
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRepository) persistAppointments() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	arr := make([]Appointment, 0, len(s.appointments))
+	for _, a := range s.appointments {
+		arr = append(arr, a)
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i].ID < arr[j].ID })
+	b, _ := json.MarshalIndent(arr, "", "  ")
+	_ = os.WriteFile(s.appointmentFile, b, 0644)
+}
+
+// appointmentRoutes registers the appointment and availability endpoints.
+func appointmentRoutes(mux *http.ServeMux, repo Repository, auth *AuthService) {
+	mux.HandleFunc("/api/doctor/schedule", auth.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		var sched DoctorSchedule
+		if err := json.NewDecoder(r.Body).Decode(&sched); err != nil {
+			http.Error(w, "bad request", 400)
+			return
+		}
+		caller, _ := CallerFromContext(r.Context())
+		if !callerIsSelf(caller, "doctor", sched.DoctorID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if err := repo.SetSchedule(sched.DoctorID, sched); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		writeJSON(w, map[string]string{"status": "ok"})
+	}))
+
+	mux.HandleFunc("/api/doctor/", func(w http.ResponseWriter, r *http.Request) {
+		// /api/doctor/{id}/slots
+		parts := splitPath(r.URL.Path, "/api/doctor/")
+		if len(parts) != 2 || parts[1] != "slots" {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "bad doctor id", 400)
+			return
+		}
+		from, to, err := parseRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		slots, err := repo.FreeSlots(id, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		writeJSON(w, slots)
+	})
+
+	mux.HandleFunc("/api/patient/appointments", auth.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := CallerFromContext(r.Context())
+		switch r.Method {
+		case http.MethodPost:
+			var body struct {
+				PatientID int       `json:"patient_id"`
+				DoctorID  int       `json:"doctor_id"`
+				Start     time.Time `json:"start"`
+				End       time.Time `json:"end"`
+				Reason    string    `json:"reason"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", 400)
+				return
+			}
+			if !callerIsSelf(caller, "patient", body.PatientID) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			appt, err := repo.BookAppointment(body.PatientID, body.DoctorID, body.Start, body.End, body.Reason)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			writeJSON(w, appt)
+		case http.MethodGet:
+			id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+			if !callerIsSelf(caller, "patient", id) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			writeJSON(w, repo.AppointmentsOfPatient(id))
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	}))
+
+	mux.HandleFunc("/api/appointments/", auth.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		// /api/appointments/{id}/cancel or /reschedule
+		parts := splitPath(r.URL.Path, "/api/appointments/")
+		if len(parts) != 2 || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "bad appointment id", 400)
+			return
+		}
+		caller, _ := CallerFromContext(r.Context())
+		switch parts[1] {
+		case "cancel":
+			appt, err := repo.CancelAppointment(caller.Role, caller.ID, id)
+			if err != nil {
+				writeAppointmentError(w, err)
+				return
+			}
+			writeJSON(w, appt)
+		case "reschedule":
+			var body struct {
+				Start time.Time `json:"start"`
+				End   time.Time `json:"end"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", 400)
+				return
+			}
+			appt, err := repo.RescheduleAppointment(caller.Role, caller.ID, id, body.Start, body.End)
+			if err != nil {
+				writeAppointmentError(w, err)
+				return
+			}
+			writeJSON(w, appt)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// writeAppointmentError maps a CancelAppointment/RescheduleAppointment error
+// to a status code, giving ErrForbidden its own 403 rather than the generic
+// 400 used for validation failures.
+func writeAppointmentError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), 400)
+}
+
+// splitPath strips prefix from path and splits the remainder on "/", dropping empties.
+func splitPath(path, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
+func parseRange(r *http.Request) (time.Time, time.Time, error) {
+	fromStr := r.URL.Query().Get("from")
+	toStr := r.URL.Query().Get("to")
+	from, err := time.Parse(time.RFC3339, fromStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("bad from")
+	}
+	to, err := time.Parse(time.RFC3339, toStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("bad to")
+	}
+	return from, to, nil
+}
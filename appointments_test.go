@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestRepo builds a MemoryRepository with one patient and one doctor,
+// bypassing NewMemoryRepository's seed-file loading.
+func newTestRepo() *MemoryRepository {
+	return &MemoryRepository{
+		patients:     map[int]Patient{1: {ID: 1, Login: "pat"}},
+		doctors:      map[int]Doctor{1: {ID: 1, Login: "doc"}},
+		selections:   map[int]int{},
+		pubsub:       NewPubSub[userKey, Event](eventBacklogSize),
+		schedules:    map[int]DoctorSchedule{},
+		appointments: map[int]Appointment{},
+		messages:     map[int]Message{},
+	}
+}
+
+func TestBookAppointmentRejectsOutsideSchedule(t *testing.T) {
+	repo := newTestRepo()
+	// Find the next Monday so the test doesn't depend on today's weekday.
+	monday := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+	if monday.Weekday() != time.Monday {
+		t.Fatalf("test setup: 2026-01-05 is not a Monday")
+	}
+	if err := repo.SetSchedule(1, DoctorSchedule{
+		SlotMinutes: 30,
+		Weekly:      []WeeklyAvailability{{Weekday: time.Monday, StartMin: 9 * 60, EndMin: 17 * 60}},
+	}); err != nil {
+		t.Fatalf("SetSchedule: %v", err)
+	}
+
+	// 03:00 on a day the doctor only works 09:00-17:00: no overlapping
+	// appointment exists, but it's still outside the doctor's hours.
+	start := monday.Add(3 * time.Hour)
+	if _, err := repo.BookAppointment(1, 1, start, start.Add(30*time.Minute), "checkup"); err == nil {
+		t.Fatalf("expected booking outside schedule to fail")
+	}
+
+	// 09:00-09:30 the same day is within the weekly window and should book.
+	within := monday.Add(9 * time.Hour)
+	if _, err := repo.BookAppointment(1, 1, within, within.Add(30*time.Minute), "checkup"); err != nil {
+		t.Fatalf("expected booking within schedule to succeed, got %v", err)
+	}
+}
+
+func TestRescheduleAppointmentRejectsOutsideSchedule(t *testing.T) {
+	repo := newTestRepo()
+	monday := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+	if err := repo.SetSchedule(1, DoctorSchedule{
+		SlotMinutes: 30,
+		Weekly:      []WeeklyAvailability{{Weekday: time.Monday, StartMin: 9 * 60, EndMin: 17 * 60}},
+	}); err != nil {
+		t.Fatalf("SetSchedule: %v", err)
+	}
+	within := monday.Add(9 * time.Hour)
+	appt, err := repo.BookAppointment(1, 1, within, within.Add(30*time.Minute), "checkup")
+	if err != nil {
+		t.Fatalf("BookAppointment: %v", err)
+	}
+
+	outside := monday.Add(3 * time.Hour)
+	if _, err := repo.RescheduleAppointment("patient", 1, appt.ID, outside, outside.Add(30*time.Minute)); err == nil {
+		t.Fatalf("expected reschedule outside schedule to fail")
+	}
+}
+
+func TestCancelAppointmentRequiresOwnership(t *testing.T) {
+	repo := newTestRepo()
+	repo.patients[2] = Patient{ID: 2, Login: "other"}
+	monday := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+	if err := repo.SetSchedule(1, DoctorSchedule{
+		SlotMinutes: 30,
+		Weekly:      []WeeklyAvailability{{Weekday: time.Monday, StartMin: 9 * 60, EndMin: 17 * 60}},
+	}); err != nil {
+		t.Fatalf("SetSchedule: %v", err)
+	}
+	within := monday.Add(9 * time.Hour)
+	appt, err := repo.BookAppointment(1, 1, within, within.Add(30*time.Minute), "checkup")
+	if err != nil {
+		t.Fatalf("BookAppointment: %v", err)
+	}
+
+	if _, err := repo.CancelAppointment("patient", 2, appt.ID); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected ErrForbidden for another patient, got %v", err)
+	}
+	if _, err := repo.CancelAppointment("patient", 1, appt.ID); err != nil {
+		t.Fatalf("expected the owning patient to cancel, got %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const tokenTTL = 12 * time.Hour
+
+// Claims are the custom JWT claims issued at login: subject is the user ID,
+// role distinguishes patient/doctor accounts sharing the same token format.
+type Claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+type contextKey int
+
+const callerContextKey contextKey = iota
+
+// Caller is the identity populated into a request's context by AuthService.Authenticate.
+type Caller struct {
+	Role      string
+	ID        int
+	JTI       string
+	ExpiresAt time.Time
+}
+
+// CallerFromContext returns the authenticated caller set by AuthService.Authenticate.
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	c, ok := ctx.Value(callerContextKey).(Caller)
+	return c, ok
+}
+
+// AuthService signs and verifies login sessions and tracks revoked tokens.
+type AuthService struct {
+	secret   []byte
+	denylist *denylist
+}
+
+func NewAuthService(secret []byte) *AuthService {
+	return &AuthService{secret: secret, denylist: newDenylist()}
+}
+
+// IssueToken signs a short-lived JWT for the given account.
+func (a *AuthService) IssueToken(role string, id int) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(id),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenTTL)),
+			ID:        makeToken(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+}
+
+// ParseToken verifies a raw JWT and returns its Caller, for callers (like
+// /api/ws) that can't rely on the Authorization header because the
+// transport doesn't let them set one.
+func (a *AuthService) ParseToken(tokenStr string) (Caller, error) {
+	return a.parse(tokenStr)
+}
+
+func (a *AuthService) parse(tokenStr string) (Caller, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (any, error) {
+		return a.secret, nil
+	})
+	if err != nil || !token.Valid {
+		return Caller{}, errors.New("invalid token")
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Caller{}, errors.New("invalid token subject")
+	}
+	if a.denylist.isRevoked(claims.ID) {
+		return Caller{}, errors.New("token revoked")
+	}
+	return Caller{
+		Role:      claims.Role,
+		ID:        id,
+		JTI:       claims.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// Authenticate requires a valid "Authorization: Bearer <token>" header and
+// populates the request context with the caller before invoking next.
+func (a *AuthService) Authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		h := r.Header.Get("Authorization")
+		if !strings.HasPrefix(h, prefix) {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		caller, err := a.parse(strings.TrimPrefix(h, prefix))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), callerContextKey, caller)))
+	}
+}
+
+// RequireSelf authenticates the request and additionally requires the caller
+// to hold the given role and to match the ID extracted from the request
+// (e.g. a patient reading their own record) before invoking next.
+func (a *AuthService) RequireSelf(role string, idFromRequest func(*http.Request) int, next http.HandlerFunc) http.HandlerFunc {
+	return a.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := CallerFromContext(r.Context())
+		if caller.Role != role || caller.ID != idFromRequest(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// callerIsSelf reports whether caller is the (role, id) it claims to be,
+// for handlers whose identity comes from a decoded body rather than a
+// request-line/query value RequireSelf can extract up front.
+func callerIsSelf(caller Caller, role string, id int) bool {
+	return caller.Role == role && caller.ID == id
+}
+
+// Revoke denylists the token's jti until it would have expired anyway.
+func (a *AuthService) Revoke(caller Caller) {
+	ttl := time.Until(caller.ExpiresAt)
+	if ttl < 0 {
+		ttl = 0
+	}
+	a.denylist.revoke(caller.JTI, ttl)
+}
+
+// denylist tracks revoked token IDs (jti) until their natural expiry.
+type denylist struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func newDenylist() *denylist {
+	return &denylist{revoked: map[string]time.Time{}}
+}
+
+func (d *denylist) revoke(jti string, ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.revoked[jti] = time.Now().Add(ttl)
+}
+
+func (d *denylist) isRevoked(jti string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	exp, ok := d.revoked[jti]
+	if !ok {
+		return false
+	}
+	if time.Now().After(exp) {
+		delete(d.revoked, jti)
+		return false
+	}
+	return true
+}
+
+// loadJWTSecret reads the signing secret from JWT_SECRET, falling back to an
+// ephemeral random secret (with a warning) so the server still boots in dev.
+func loadJWTSecret() []byte {
+	if s := os.Getenv("JWT_SECRET"); s != "" {
+		return []byte(s)
+	}
+	log.Printf("JWT_SECRET not set; using an ephemeral secret, sessions will not survive a restart")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("generate jwt secret: %v", err)
+	}
+	return b
+}
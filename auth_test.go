@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticateRejectsMissingOrInvalidToken(t *testing.T) {
+	auth := NewAuthService([]byte("test-secret"))
+	called := false
+	h := auth.Authenticate(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	req := httptest.NewRequest(http.MethodGet, "/api/whatever", nil)
+	rr := httptest.NewRecorder()
+	h(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with no Authorization header, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/whatever", nil)
+	req.Header.Set("Authorization", "Bearer not-a-real-token")
+	rr = httptest.NewRecorder()
+	h(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a garbage token, got %d", rr.Code)
+	}
+	if called {
+		t.Fatalf("next handler must not run when authentication fails")
+	}
+}
+
+func TestAuthenticatePopulatesCaller(t *testing.T) {
+	auth := NewAuthService([]byte("test-secret"))
+	token, err := auth.IssueToken("patient", 7)
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+
+	var caller Caller
+	var ok bool
+	h := auth.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok = CallerFromContext(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/whatever", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	h(httptest.NewRecorder(), req)
+
+	if !ok {
+		t.Fatalf("expected caller in context")
+	}
+	if caller.Role != "patient" || caller.ID != 7 {
+		t.Fatalf("got caller %+v, want role=patient id=7", caller)
+	}
+}
+
+func TestCallerIsSelf(t *testing.T) {
+	caller := Caller{Role: "patient", ID: 3}
+	if !callerIsSelf(caller, "patient", 3) {
+		t.Fatalf("expected matching role/id to be self")
+	}
+	if callerIsSelf(caller, "doctor", 3) {
+		t.Fatalf("expected mismatched role to be rejected")
+	}
+	if callerIsSelf(caller, "patient", 4) {
+		t.Fatalf("expected mismatched id to be rejected")
+	}
+}
@@ -2,30 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Patient struct {
-	ID       int    `json:"id"`
-	Login    string `json:"login"`
+	ID       int    `json:"id" gorm:"primaryKey"`
+	Login    string `json:"login" gorm:"uniqueIndex"`
 	Password string `json:"password"`
 	Name     string `json:"name"`
 }
 
 type Doctor struct {
-	ID       int    `json:"id"`
-	Login    string `json:"login"`
+	ID       int    `json:"id" gorm:"primaryKey"`
+	Login    string `json:"login" gorm:"uniqueIndex"`
 	Password string `json:"password"`
 	First    string `json:"first_name"`
 	Last     string `json:"last_name"`
@@ -38,8 +43,9 @@ type Seed struct {
 	Doctors  []Doctor  `json:"doctors"`
 }
 
+// Selection is keyed by patient, since a patient has at most one active selection.
 type Selection struct {
-	PatientID int `json:"patient_id"`
+	PatientID int `json:"patient_id" gorm:"primaryKey"`
 	DoctorID  int `json:"doctor_id"`
 }
 
@@ -50,7 +56,7 @@ type LoginResp struct {
 	Name  string `json:"name"`
 }
 
-type Store struct {
+type MemoryRepository struct {
 	mu       sync.RWMutex
 	patients map[int]Patient
 	doctors  map[int]Doctor
@@ -60,12 +66,36 @@ type Store struct {
 		pass string
 	}
 	selections map[int]int
-	subs       map[int]map[chan struct{}]struct{}
-
-	selectionFile string
+	pubsub     *PubSub[userKey, Event]
+
+	schedules    map[int]DoctorSchedule
+	appointments map[int]Appointment
+	nextApptID   int
+
+	messages   map[int]Message
+	nextMsgID  int
+	messageDir string
+
+	selectionFile   string
+	appointmentFile string
+
+	// selectionsDirty/appointmentsDirty drive the single persistence worker
+	// goroutine (see runPersistenceWorker): mutations signal the relevant
+	// channel instead of spawning their own "go s.persistX()" goroutine, so
+	// writes to a given file never run concurrently with each other and
+	// can't race on os.WriteFile. Each is buffered to 1 so a burst of
+	// mutations collapses into a single pending write.
+	selectionsDirty   chan struct{}
+	appointmentsDirty chan struct{}
+
+	// done stops runPersistenceWorker; Shutdown closes it and then waits on
+	// stopped so it never returns while a write is still in flight (and a
+	// caller like a test's t.TempDir cleanup could race it).
+	done    chan struct{}
+	stopped chan struct{}
 }
 
-func NewStore(seedPath string) (*Store, error) {
+func NewMemoryRepository(seedPath string) (*MemoryRepository, error) {
 	b, err := os.ReadFile(seedPath)
 	if err != nil {
 		return nil, err
@@ -75,7 +105,7 @@ func NewStore(seedPath string) (*Store, error) {
 		return nil, err
 	}
 
-	st := &Store{
+	st := &MemoryRepository{
 		patients: map[int]Patient{},
 		doctors:  map[int]Doctor{},
 		byLogin: map[string]struct {
@@ -83,9 +113,19 @@ func NewStore(seedPath string) (*Store, error) {
 			id   int
 			pass string
 		}{},
-		selections:    map[int]int{},
-		subs:          map[int]map[chan struct{}]struct{}{},
-		selectionFile: filepath.Join(filepath.Dir(seedPath), "selections.json"),
+		selections:      map[int]int{},
+		pubsub:          NewPubSub[userKey, Event](eventBacklogSize),
+		schedules:       map[int]DoctorSchedule{},
+		appointments:    map[int]Appointment{},
+		messages:        map[int]Message{},
+		messageDir:      filepath.Join(filepath.Dir(seedPath), "messages"),
+		selectionFile:   filepath.Join(filepath.Dir(seedPath), "selections.json"),
+		appointmentFile: filepath.Join(filepath.Dir(seedPath), "appointments.json"),
+
+		selectionsDirty:   make(chan struct{}, 1),
+		appointmentsDirty: make(chan struct{}, 1),
+		done:              make(chan struct{}),
+		stopped:           make(chan struct{}),
 	}
 	for _, p := range s.Patients {
 		st.patients[p.ID] = p
@@ -102,13 +142,55 @@ func NewStore(seedPath string) (*Store, error) {
 			id   int
 			pass string
 		}{"doctor", d.ID, d.Password}
-		st.subs[d.ID] = map[chan struct{}]struct{}{}
 	}
 	_ = st.loadSelections()
+	_ = st.loadAppointments()
+	_ = st.loadMessages()
+	go st.runPersistenceWorker()
 	return st, nil
 }
 
-func (s *Store) loadSelections() error {
+// runPersistenceWorker is the sole goroutine that ever writes
+// selectionFile/appointmentFile: mutations signal selectionsDirty/
+// appointmentsDirty rather than writing (or spawning a writer) themselves,
+// so two concurrent mutations can never race each other's os.WriteFile
+// calls to the same path. It exits once Shutdown closes done, draining any
+// already-pending write first so Shutdown can't return mid-write.
+func (s *MemoryRepository) runPersistenceWorker() {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.selectionsDirty:
+			s.persistSelections()
+		case <-s.appointmentsDirty:
+			s.persistAppointments()
+		case <-s.done:
+			select {
+			case <-s.selectionsDirty:
+				s.persistSelections()
+			default:
+			}
+			select {
+			case <-s.appointmentsDirty:
+				s.persistAppointments()
+			default:
+			}
+			return
+		}
+	}
+}
+
+// triggerPersist requests a write on ch without blocking: if a write is
+// already queued, the request is dropped since that pending write will
+// persist whatever the current state is by the time it runs.
+func triggerPersist(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *MemoryRepository) loadSelections() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	b, err := os.ReadFile(s.selectionFile)
@@ -125,7 +207,7 @@ func (s *Store) loadSelections() error {
 	return nil
 }
 
-func (s *Store) persistSelections() {
+func (s *MemoryRepository) persistSelections() {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	arr := make([]Selection, 0, len(s.selections))
@@ -136,16 +218,18 @@ func (s *Store) persistSelections() {
 	_ = os.WriteFile(s.selectionFile, b, 0644)
 }
 
-func (s *Store) Login(role, login, pass string) (LoginResp, error) {
+// Login verifies role-scoped credentials against the bcrypt hash loaded from
+// seed data. The returned LoginResp has no token set; the caller is
+// responsible for issuing a session via AuthService.
+func (s *MemoryRepository) Login(role, login, pass string) (LoginResp, error) {
 	key := role + ":" + login
 	entry, ok := s.byLogin[key]
-	if !ok || entry.pass != pass {
+	if !ok || bcrypt.CompareHashAndPassword([]byte(entry.pass), []byte(pass)) != nil {
 		return LoginResp{}, errors.New("invalid credentials")
 	}
 	resp := LoginResp{
-		Token: makeToken(),
-		Role:  entry.role,
-		ID:    entry.id,
+		Role: entry.role,
+		ID:   entry.id,
 	}
 	if role == "patient" {
 		resp.Name = s.patients[entry.id].Name
@@ -156,21 +240,21 @@ func (s *Store) Login(role, login, pass string) (LoginResp, error) {
 	return resp, nil
 }
 
-func (s *Store) GetPatient(id int) (Patient, bool) {
+func (s *MemoryRepository) GetPatient(id int) (Patient, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	p, ok := s.patients[id]
 	return p, ok
 }
 
-func (s *Store) GetDoctor(id int) (Doctor, bool) {
+func (s *MemoryRepository) GetDoctor(id int) (Doctor, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	d, ok := s.doctors[id]
 	return d, ok
 }
 
-func (s *Store) ListDoctors() []Doctor {
+func (s *MemoryRepository) ListDoctors() []Doctor {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	out := make([]Doctor, 0, len(s.doctors))
@@ -180,7 +264,7 @@ func (s *Store) ListDoctors() []Doctor {
 	return out
 }
 
-func (s *Store) SelectDoctor(patientID, doctorID int) error {
+func (s *MemoryRepository) SelectDoctor(patientID, doctorID int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if _, ok := s.patients[patientID]; !ok {
@@ -190,17 +274,24 @@ func (s *Store) SelectDoctor(patientID, doctorID int) error {
 		return errors.New("doctor not found")
 	}
 	s.selections[patientID] = doctorID
-	go s.persistSelections()
-	for ch := range s.subs[doctorID] {
-		select {
-		case ch <- struct{}{}:
-		default:
-		}
-	}
+	triggerPersist(s.selectionsDirty)
+	s.pubsub.Publish(userKey{"doctor", doctorID}, Event{Type: EventUpdate})
+	selectionsTotal.Inc()
 	return nil
 }
 
-func (s *Store) PatientsOfDoctor(doctorID int) []Patient {
+// SelectedDoctor returns the doctor a patient has currently selected, if any.
+func (s *MemoryRepository) SelectedDoctor(patientID int) (Doctor, bool) {
+	s.mu.RLock()
+	docID, ok := s.selections[patientID]
+	s.mu.RUnlock()
+	if !ok {
+		return Doctor{}, false
+	}
+	return s.GetDoctor(docID)
+}
+
+func (s *MemoryRepository) PatientsOfDoctor(doctorID int) []Patient {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	var res []Patient
@@ -214,45 +305,73 @@ func (s *Store) PatientsOfDoctor(doctorID int) []Patient {
 	return res
 }
 
-func (s *Store) Subscribe(doctorID int) (ch chan struct{}, cancel func()) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	ch = make(chan struct{}, 1)
-	if _, ok := s.subs[doctorID]; !ok {
-		s.subs[doctorID] = map[chan struct{}]struct{}{}
-	}
-	s.subs[doctorID][ch] = struct{}{}
-	cancel = func() {
-		s.mu.Lock()
-		defer s.mu.Unlock()
-		delete(s.subs[doctorID], ch)
-		close(ch)
-	}
-	return
+func (s *MemoryRepository) SubscribeUser(role string, id int) (ch chan Envelope[Event], cancel func()) {
+	return s.pubsub.Subscribe(userKey{role, id})
+}
+
+func (s *MemoryRepository) RecentEvents(role string, id int, afterSeq uint64) []Envelope[Event] {
+	return s.pubsub.Since(userKey{role, id}, afterSeq)
+}
+
+func (s *MemoryRepository) SubscriberCount(role string, id int) int {
+	return s.pubsub.Count(userKey{role, id})
+}
+
+func (s *MemoryRepository) Shutdown() {
+	s.pubsub.CloseAll()
+	close(s.done)
+	<-s.stopped
 }
 
+// makeToken returns a 24-character random identifier drawn from
+// crypto/rand, suitable for anything that must not be guessable (JWT jti,
+// X-Request-ID): unlike math/rand it can't be predicted from the wall-clock
+// seed it'd otherwise be reseeded from on every call.
 func makeToken() string {
 	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
-	rand.Seed(time.Now().UnixNano())
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("generate random token: %v", err)
+	}
 	sb := strings.Builder{}
-	for i := 0; i < 24; i++ {
-		sb.WriteByte(letters[rand.Intn(len(letters))])
+	for _, c := range b {
+		sb.WriteByte(letters[int(c)%len(letters)])
 	}
 	return sb.String()
 }
 
+// ready flips to true once the repository (including seed data) has
+// finished loading; /api/ready fails until then.
+var ready atomic.Bool
+
 func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/", http.FileServer(http.Dir("web")))
-	store, err := NewStore(filepath.Join("data", "seed.json"))
+	repo, err := newRepository(filepath.Join("data", "seed.json"))
 	if err != nil {
 		log.Fatalf("seed load: %v", err)
 	}
+	ready.Store(true)
+	auth := NewAuthService(loadJWTSecret())
+
+	mux.Handle("/metrics", promhttp.Handler())
 
 	mux.HandleFunc("/api/ping", func(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, map[string]string{"ok": "true"})
 	})
 
+	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("/api/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, map[string]string{"status": "ready"})
+	})
+
 	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", 405)
@@ -267,36 +386,56 @@ func main() {
 			http.Error(w, "bad request", 400)
 			return
 		}
-		resp, err := store.Login(body.Role, body.Login, body.Password)
+		resp, err := repo.Login(body.Role, body.Login, body.Password)
 		if err != nil {
 			http.Error(w, "invalid credentials", 401)
 			return
 		}
+		token, err := auth.IssueToken(resp.Role, resp.ID)
+		if err != nil {
+			http.Error(w, "internal error", 500)
+			return
+		}
+		resp.Token = token
 		writeJSON(w, resp)
 	})
 
-	mux.HandleFunc("/api/patient/me", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/logout", auth.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		caller, _ := CallerFromContext(r.Context())
+		auth.Revoke(caller)
+		writeJSON(w, map[string]string{"status": "ok"})
+	}))
+
+	mux.HandleFunc("/api/patient/me", auth.RequireSelf("patient", func(r *http.Request) int {
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		return id
+	}, func(w http.ResponseWriter, r *http.Request) {
 		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
-		p, ok := store.GetPatient(id)
+		p, ok := repo.GetPatient(id)
 		if !ok {
 			http.Error(w, "not found", 404)
 			return
 		}
-		store.mu.RLock()
-		docID := store.selections[p.ID]
-		store.mu.RUnlock()
 		var doctor *Doctor
-		if d, ok := store.GetDoctor(docID); ok {
+		if d, ok := repo.SelectedDoctor(p.ID); ok {
 			doctor = &d
 		}
-		writeJSON(w, map[string]any{"patient": p, "selected_doctor": doctor})
-	})
+		writeJSON(w, map[string]any{
+			"patient":         p,
+			"selected_doctor": doctor,
+			"unread_messages": repo.UnreadCount("patient", p.ID),
+		})
+	}))
 
 	mux.HandleFunc("/api/doctors", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, store.ListDoctors())
+		writeJSON(w, repo.ListDoctors())
 	})
 
-	mux.HandleFunc("/api/patient/select-doctor", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/patient/select-doctor", auth.Authenticate(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", 405)
 			return
@@ -309,66 +448,106 @@ func main() {
 			http.Error(w, "bad request", 400)
 			return
 		}
-		if err := store.SelectDoctor(body.PatientID, body.DoctorID); err != nil {
+		caller, _ := CallerFromContext(r.Context())
+		if !callerIsSelf(caller, "patient", body.PatientID) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if err := repo.SelectDoctor(body.PatientID, body.DoctorID); err != nil {
 			http.Error(w, err.Error(), 400)
 			return
 		}
 		writeJSON(w, map[string]string{"status": "ok"})
-	})
+	}))
 
-	mux.HandleFunc("/api/doctor", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/doctor", auth.RequireSelf("doctor", func(r *http.Request) int {
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		return id
+	}, func(w http.ResponseWriter, r *http.Request) {
 		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
-		d, ok := store.GetDoctor(id)
+		d, ok := repo.GetDoctor(id)
 		if !ok {
 			http.Error(w, "not found", 404)
 			return
 		}
-		pts := store.PatientsOfDoctor(id)
-		writeJSON(w, map[string]any{"doctor": d, "patients": pts})
-	})
-
-	mux.HandleFunc("/api/doctor/stream", func(w http.ResponseWriter, r *http.Request) {
-		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
-		if _, ok := store.GetDoctor(id); !ok {
-			http.Error(w, "not found", 404)
+		pts := repo.PatientsOfDoctor(id)
+		writeJSON(w, map[string]any{
+			"doctor":          d,
+			"patients":        pts,
+			"unread_messages": repo.UnreadCount("doctor", id),
+		})
+	}))
+
+	mux.HandleFunc("/api/ws", func(w http.ResponseWriter, r *http.Request) {
+		// A WebSocket upgrade can't carry a custom Authorization header, so
+		// the token travels as a query parameter instead of going through
+		// auth.Authenticate.
+		caller, err := auth.ParseToken(r.URL.Query().Get("token"))
+		if err != nil {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
 			return
 		}
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		ch, cancel := store.Subscribe(id)
-		defer cancel()
-
-		ctx := r.Context()
-		fmt.Fprintf(w, "event: ping\ndata: ok\n\n")
-		flusher, _ := w.(http.Flusher)
-		if flusher != nil {
-			flusher.Flush()
+		role := r.URL.Query().Get("role")
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		if caller.Role != role || caller.ID != id {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
 		}
-
-		for {
-			select {
-			case <-ctx.Done():
+		switch role {
+		case "patient":
+			if _, ok := repo.GetPatient(id); !ok {
+				http.Error(w, "not found", 404)
 				return
-			case <-ch:
-				fmt.Fprintf(w, "event: update\ndata: changed\n\n")
-				if flusher != nil {
-					flusher.Flush()
-				}
-			case <-time.After(25 * time.Second):
-				fmt.Fprintf(w, "event: ping\ndata: ok\n\n")
-				if flusher != nil {
-					flusher.Flush()
-				}
 			}
+		case "doctor":
+			if _, ok := repo.GetDoctor(id); !ok {
+				http.Error(w, "not found", 404)
+				return
+			}
+		default:
+			http.Error(w, "role must be patient or doctor", 400)
+			return
+		}
+		if repo.SubscriberCount(role, id) >= maxSubscribersPerUser {
+			http.Error(w, "too many subscribers", http.StatusTooManyRequests)
+			return
 		}
+		serveWS(w, r, repo, role, id)
 	})
 
+	appointmentRoutes(mux, repo, auth)
+	messageRoutes(mux, repo, auth)
+
 	addr := ":8080"
-	log.Printf("server on %s", addr)
-	srv := &http.Server{Addr: addr, Handler: withCORS(mux)}
-	log.Fatal(srv.ListenAndServe())
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: loggingMiddleware(withCORS(mux)),
+		// Slow clients trickling in headers shouldn't tie up a connection
+		// indefinitely. WriteTimeout is left at its zero-value (no limit):
+		// /api/ws hijacks the connection on Accept, after which nhooyr owns
+		// the net.Conn and enforces its own per-write deadlines (see
+		// serveWS), so the server's WriteTimeout no longer applies to it.
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("server on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("listen: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Printf("shutting down")
+
+	repo.Shutdown()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	shutdown(shutdownCtx, srv)
 }
 
 func writeJSON(w http.ResponseWriter, v any) {
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+// TestMakeTokenIsUnique guards against a regression back to the old
+// math/rand generator reseeded from the wall clock, which produced
+// identical tokens for calls made within the same clock tick.
+func TestMakeTokenIsUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		tok := makeToken()
+		if len(tok) != 24 {
+			t.Fatalf("expected a 24-character token, got %q", tok)
+		}
+		if seen[tok] {
+			t.Fatalf("makeToken produced a duplicate: %q", tok)
+		}
+		seen[tok] = true
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const (
+	// eventBacklogSize is how many past events PubSub retains per (role, id)
+	// so a reconnecting /api/ws client can catch up via last_seq.
+	eventBacklogSize = 32
+
+	// maxSubscribersPerUser caps concurrent /api/ws connections per (role,
+	// id); beyond it the handler returns 429 rather than letting an
+	// unbounded number of idle tabs pile up.
+	maxSubscribersPerUser = 4
+
+	// wsWriteDeadline bounds each write (event delivery or keepalive ping):
+	// a subscriber that hasn't drained within this long is force-cancelled
+	// and removed so it stops silently falling behind.
+	wsWriteDeadline = 10 * time.Second
+
+	wsPingInterval = 25 * time.Second
+)
+
+// Message is a single chat message between a patient and their selected
+// doctor. Only that pairing may message each other; see SendMessage.
+type Message struct {
+	ID        int        `json:"id" gorm:"primaryKey"`
+	FromRole  string     `json:"from_role"`
+	FromID    int        `json:"from_id"`
+	ToRole    string     `json:"to_role"`
+	ToID      int        `json:"to_id"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// Event types pushed over /api/ws: "update" means an appointment or
+// selection changed and the client should refetch; "message" carries a
+// newly sent Message addressed to the subscriber.
+const (
+	EventUpdate  = "update"
+	EventMessage = "message"
+)
+
+// Event is a single value pushed to a user's WebSocket connection.
+type Event struct {
+	Type    string   `json:"type"`
+	Message *Message `json:"message,omitempty"`
+}
+
+// userKey identifies a user (by role and ID) as a PubSub subscription key.
+type userKey struct {
+	Role string
+	ID   int
+}
+
+// wsFrame is the JSON shape written to an /api/ws client: the event plus the
+// sequence number PubSub assigned it, so the client can reconnect with
+// ?last_seq=<seq> to replay whatever it missed.
+type wsFrame struct {
+	Seq uint64 `json:"seq"`
+	Event
+}
+
+// serveWS upgrades the request to a WebSocket, replays any backlogged
+// events newer than the client's last_seq, and then forwards every new
+// Event published to (role, id) until the client disconnects. Each write
+// (event delivery or keepalive ping) is bounded by wsWriteDeadline: a
+// subscriber that isn't draining its connection is force-cancelled and
+// removed rather than left to silently fall behind.
+func serveWS(w http.ResponseWriter, r *http.Request, repo Repository, role string, id int) {
+	lastSeq := uint64(0)
+	if v := r.URL.Query().Get("last_seq"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			lastSeq = n
+		}
+	}
+
+	// The REST API already allows any origin (see withCORS); match that here
+	// rather than rejecting cross-origin WebSocket upgrades.
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		return
+	}
+	defer c.CloseNow()
+
+	ch, cancel := repo.SubscribeUser(role, id)
+	defer cancel()
+
+	wsActiveSubscribers.WithLabelValues(role).Inc()
+	defer wsActiveSubscribers.WithLabelValues(role).Dec()
+
+	ctx := r.Context()
+	writeDeadline := func(ctx context.Context) (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, wsWriteDeadline)
+	}
+
+	seen := lastSeq
+	for _, env := range repo.RecentEvents(role, id, lastSeq) {
+		wctx, cancelWrite := writeDeadline(ctx)
+		err := wsjson.Write(wctx, c, wsFrame{Seq: env.Seq, Event: env.Value})
+		cancelWrite()
+		if err != nil {
+			c.Close(websocket.StatusPolicyViolation, "write deadline exceeded")
+			return
+		}
+		seen = env.Seq
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.Close(websocket.StatusNormalClosure, "")
+			return
+		case env, ok := <-ch:
+			if !ok {
+				// Shutdown closed our channel; disconnect cleanly.
+				c.Close(websocket.StatusGoingAway, "server shutting down")
+				return
+			}
+			if env.Seq <= seen {
+				continue // already delivered during backlog replay above
+			}
+			seen = env.Seq
+			wctx, cancelWrite := writeDeadline(ctx)
+			err := wsjson.Write(wctx, c, wsFrame{Seq: env.Seq, Event: env.Value})
+			cancelWrite()
+			if err != nil {
+				c.Close(websocket.StatusPolicyViolation, "write deadline exceeded")
+				return
+			}
+		case <-time.After(wsPingInterval):
+			wctx, cancelWrite := writeDeadline(ctx)
+			err := c.Ping(wctx)
+			cancelWrite()
+			if err != nil {
+				c.Close(websocket.StatusPolicyViolation, "write deadline exceeded")
+				return
+			}
+		}
+	}
+}
+
+// messageRoutes registers the chat endpoints.
+func messageRoutes(mux *http.ServeMux, repo Repository, auth *AuthService) {
+	mux.HandleFunc("/api/messages", auth.Authenticate(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := CallerFromContext(r.Context())
+		switch r.Method {
+		case http.MethodPost:
+			var body struct {
+				FromRole string `json:"from_role"`
+				FromID   int    `json:"from_id"`
+				ToRole   string `json:"to_role"`
+				ToID     int    `json:"to_id"`
+				Body     string `json:"body"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "bad request", 400)
+				return
+			}
+			if !callerIsSelf(caller, body.FromRole, body.FromID) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			msg, err := repo.SendMessage(body.FromRole, body.FromID, body.ToRole, body.ToID, body.Body)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			writeJSON(w, msg)
+		case http.MethodGet:
+			role := r.URL.Query().Get("role")
+			id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+			if !callerIsSelf(caller, role, id) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			peerID, _ := strconv.Atoi(r.URL.Query().Get("peer_id"))
+			since := time.Time{}
+			if s := r.URL.Query().Get("since"); s != "" {
+				t, err := time.Parse(time.RFC3339, s)
+				if err != nil {
+					http.Error(w, "bad since", 400)
+					return
+				}
+				since = t
+			}
+			msgs, err := repo.MessagesWith(role, id, peerID, since)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			writeJSON(w, msgs)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	}))
+}
+
+// peerRole returns the role that role is allowed to message: patients only
+// message doctors and vice versa.
+func peerRole(role string) (string, error) {
+	switch role {
+	case "patient":
+		return "doctor", nil
+	case "doctor":
+		return "patient", nil
+	default:
+		return "", errors.New("role must be patient or doctor")
+	}
+}
+
+// authorizeMessage enforces that a patient may only message their currently
+// selected doctor, and a doctor may only message patients from
+// PatientsOfDoctor.
+func authorizeMessage(repo interface {
+	SelectedDoctor(patientID int) (Doctor, bool)
+	PatientsOfDoctor(doctorID int) []Patient
+}, fromRole string, fromID, toID int) error {
+	switch fromRole {
+	case "patient":
+		d, ok := repo.SelectedDoctor(fromID)
+		if !ok || d.ID != toID {
+			return errors.New("patient has not selected this doctor")
+		}
+	case "doctor":
+		for _, p := range repo.PatientsOfDoctor(fromID) {
+			if p.ID == toID {
+				return nil
+			}
+		}
+		return errors.New("patient is not one of this doctor's patients")
+	}
+	return nil
+}
+
+func (s *MemoryRepository) SendMessage(fromRole string, fromID int, toRole string, toID int, body string) (Message, error) {
+	wantToRole, err := peerRole(fromRole)
+	if err != nil {
+		return Message{}, err
+	}
+	if toRole != wantToRole {
+		return Message{}, errors.New("to_role does not match from_role")
+	}
+	if err := authorizeMessage(s, fromRole, fromID, toID); err != nil {
+		return Message{}, err
+	}
+
+	s.mu.Lock()
+	s.nextMsgID++
+	msg := Message{
+		ID:        s.nextMsgID,
+		FromRole:  fromRole,
+		FromID:    fromID,
+		ToRole:    toRole,
+		ToID:      toID,
+		Body:      body,
+		CreatedAt: time.Now(),
+	}
+	s.messages[msg.ID] = msg
+	s.mu.Unlock()
+
+	if err := s.appendMessage(msg); err != nil {
+		return Message{}, err
+	}
+	s.pubsub.Publish(userKey{toRole, toID}, Event{Type: EventMessage, Message: &msg})
+	return msg, nil
+}
+
+func (s *MemoryRepository) MessagesWith(role string, id, peerID int, since time.Time) ([]Message, error) {
+	wantPeerRole, err := peerRole(role)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Message
+	for msgID, m := range s.messages {
+		between := (m.FromRole == role && m.FromID == id && m.ToRole == wantPeerRole && m.ToID == peerID) ||
+			(m.ToRole == role && m.ToID == id && m.FromRole == wantPeerRole && m.FromID == peerID)
+		if !between || m.CreatedAt.Before(since) {
+			continue
+		}
+		if m.ToRole == role && m.ToID == id && m.ReadAt == nil {
+			now := time.Now()
+			m.ReadAt = &now
+			s.messages[msgID] = m
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (s *MemoryRepository) UnreadCount(role string, id int) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, m := range s.messages {
+		if m.ToRole == role && m.ToID == id && m.ReadAt == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// messageLogFile returns today's rotated JSONL log path, creating
+// s.messageDir if needed.
+func (s *MemoryRepository) messageLogFile() (string, error) {
+	if err := os.MkdirAll(s.messageDir, 0755); err != nil {
+		return "", err
+	}
+	name := "messages-" + time.Now().Format("2006-01-02") + ".jsonl"
+	return filepath.Join(s.messageDir, name), nil
+}
+
+// appendMessage appends msg as one JSON line to today's log file. The log is
+// append-only: a ReadAt set later by MessagesWith is kept in memory only and
+// is not rewritten back into the log, so unread state resets across restarts.
+func (s *MemoryRepository) appendMessage(msg Message) error {
+	path, err := s.messageLogFile()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// loadMessages replays every rotated log file in s.messageDir to rebuild the
+// in-memory message set on startup.
+func (s *MemoryRepository) loadMessages() error {
+	entries, err := os.ReadDir(s.messageDir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(s.messageDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var m Message
+			if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+				continue
+			}
+			s.messages[m.ID] = m
+			if m.ID > s.nextMsgID {
+				s.nextMsgID = m.ID
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestMessageRepo builds on newTestRepo with a real messageDir so
+// SendMessage's appendMessage (which MkdirAll's it) has somewhere to write.
+func newTestMessageRepo(t *testing.T) *MemoryRepository {
+	t.Helper()
+	repo := newTestRepo()
+	repo.messageDir = t.TempDir()
+	return repo
+}
+
+func TestSendMessageRejectsPatientMessagingNonSelectedDoctor(t *testing.T) {
+	repo := newTestMessageRepo(t)
+	// repo.selections is empty: patient 1 has not selected doctor 1.
+	if _, err := repo.SendMessage("patient", 1, "doctor", 1, "hi"); err == nil {
+		t.Fatalf("expected SendMessage to reject an unselected doctor")
+	}
+}
+
+func TestSendMessageRejectsDoctorMessagingNonPatient(t *testing.T) {
+	repo := newTestMessageRepo(t)
+	repo.patients[2] = Patient{ID: 2, Login: "other"}
+	repo.selections[1] = 1 // patient 1 selected doctor 1; patient 2 has not.
+	if _, err := repo.SendMessage("doctor", 1, "patient", 2, "hi"); err == nil {
+		t.Fatalf("expected SendMessage to reject a patient not of this doctor")
+	}
+}
+
+func TestMessagesWithFiltersSinceAndMarksRead(t *testing.T) {
+	repo := newTestMessageRepo(t)
+	repo.selections[1] = 1 // patient 1 <-> doctor 1
+
+	if _, err := repo.SendMessage("patient", 1, "doctor", 1, "first"); err != nil {
+		t.Fatalf("SendMessage(first): %v", err)
+	}
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	if _, err := repo.SendMessage("patient", 1, "doctor", 1, "second"); err != nil {
+		t.Fatalf("SendMessage(second): %v", err)
+	}
+
+	msgs, err := repo.MessagesWith("doctor", 1, 1, cutoff)
+	if err != nil {
+		t.Fatalf("MessagesWith: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Body != "second" {
+		t.Fatalf("expected only the message sent after cutoff, got %+v", msgs)
+	}
+	if msgs[0].ReadAt == nil {
+		t.Fatalf("expected MessagesWith to mark the returned message read")
+	}
+	firstReadAt := *msgs[0].ReadAt
+
+	// Calling again must not re-stamp an already-read message.
+	msgs, err = repo.MessagesWith("doctor", 1, 1, cutoff)
+	if err != nil {
+		t.Fatalf("MessagesWith (second call): %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].ReadAt == nil || !msgs[0].ReadAt.Equal(firstReadAt) {
+		t.Fatalf("expected ReadAt to stay fixed across repeated reads, got %+v", msgs)
+	}
+}
+
+func TestUnreadCountReflectsReadState(t *testing.T) {
+	repo := newTestMessageRepo(t)
+	repo.selections[1] = 1
+
+	if _, err := repo.SendMessage("patient", 1, "doctor", 1, "hi"); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if n := repo.UnreadCount("doctor", 1); n != 1 {
+		t.Fatalf("expected 1 unread message, got %d", n)
+	}
+
+	if _, err := repo.MessagesWith("doctor", 1, 1, time.Time{}); err != nil {
+		t.Fatalf("MessagesWith: %v", err)
+	}
+	if n := repo.UnreadCount("doctor", 1); n != 0 {
+		t.Fatalf("expected 0 unread messages after reading, got %d", n)
+	}
+}
+
+func TestPeerRoleRejectsUnknownRole(t *testing.T) {
+	if _, err := peerRole("nurse"); err == nil {
+		t.Fatalf("expected peerRole to reject an unrecognized role")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total HTTP requests, labeled by route, method, and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency in seconds, labeled by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	wsActiveSubscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ws_active_subscribers",
+		Help: "Number of currently connected /api/ws subscribers, labeled by role.",
+	}, []string{"role"})
+
+	selectionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "selections_total",
+		Help: "Total number of doctor selections made by patients.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration, wsActiveSubscribers, selectionsTotal)
+}
+
+// statusWriter records the status code and byte count written through it so
+// loggingMiddleware can report them after the handler returns.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Hijack forwards to the underlying ResponseWriter so /api/ws can still
+// upgrade the connection through this middleware; without it every
+// WebSocket accept would fail with "does not implement http.Hijacker".
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying ResponseWriter does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// loggingMiddleware emits one structured JSON access-log line per request
+// and records the http_requests_total/http_request_duration_seconds
+// metrics. It assigns an X-Request-ID if the client didn't send one.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqID := r.Header.Get("X-Request-ID")
+		if reqID == "" {
+			reqID = makeToken()
+		}
+		w.Header().Set("X-Request-ID", reqID)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		dur := time.Since(start)
+
+		line, _ := json.Marshal(map[string]any{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      sw.status,
+			"bytes":       sw.bytes,
+			"duration_ms": float64(dur.Microseconds()) / 1000,
+			"remote":      r.RemoteAddr,
+			"request_id":  reqID,
+		})
+		log.Println(string(line))
+
+		route := normalizeRoute(r.URL.Path)
+		code := strconv.Itoa(sw.status)
+		httpRequestsTotal.WithLabelValues(route, r.Method, code).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(dur.Seconds())
+	})
+}
+
+// normalizeRoute replaces purely-numeric path segments (appointment IDs,
+// doctor IDs, ...) with "{id}" so the route label's cardinality is bounded
+// by the mux's route shapes instead of growing with every ID ever
+// requested, e.g. "/api/appointments/42/cancel" -> "/api/appointments/{id}/cancel".
+func normalizeRoute(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if _, err := strconv.Atoi(seg); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestNormalizeRoute(t *testing.T) {
+	cases := map[string]string{
+		"/api/appointments/42/cancel":   "/api/appointments/{id}/cancel",
+		"/api/doctor/7/slots":           "/api/doctor/{id}/slots",
+		"/api/doctor/schedule":          "/api/doctor/schedule",
+		"/api/patient/appointments":     "/api/patient/appointments",
+		"/api/messages":                 "/api/messages",
+		"/api/appointments/123/resched": "/api/appointments/{id}/resched",
+	}
+	for in, want := range cases {
+		if got := normalizeRoute(in); got != want {
+			t.Errorf("normalizeRoute(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
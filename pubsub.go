@@ -0,0 +1,115 @@
+package main
+
+import "sync"
+
+// Envelope pairs a published value with the per-key sequence number PubSub
+// assigned it. A reconnecting subscriber can record the highest Seq it saw
+// and pass it to Since to catch up on whatever it missed while
+// disconnected — the WebSocket equivalent of SSE's Last-Event-ID.
+type Envelope[V any] struct {
+	Seq   uint64
+	Value V
+}
+
+// PubSub fans out values of type V to subscribers keyed by K. It has no
+// storage dependency so every Repository backend, and any other subsystem
+// that needs per-key fan-out (per-user WebSocket multiplexing, ...), can
+// share one implementation instead of re-deriving its own. Every published
+// value is also kept in a bounded per-key backlog so a subscriber that
+// reconnects can replay what it missed.
+type PubSub[K comparable, V any] struct {
+	mu         sync.Mutex
+	subs       map[K]map[chan Envelope[V]]struct{}
+	seq        map[K]uint64
+	backlog    map[K][]Envelope[V]
+	backlogCap int
+}
+
+// NewPubSub builds a PubSub that retains up to backlogCap past events per
+// key for Since to replay.
+func NewPubSub[K comparable, V any](backlogCap int) *PubSub[K, V] {
+	return &PubSub[K, V]{
+		subs:       map[K]map[chan Envelope[V]]struct{}{},
+		seq:        map[K]uint64{},
+		backlog:    map[K][]Envelope[V]{},
+		backlogCap: backlogCap,
+	}
+}
+
+func (p *PubSub[K, V]) Subscribe(key K) (ch chan Envelope[V], cancel func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch = make(chan Envelope[V], 8)
+	if _, ok := p.subs[key]; !ok {
+		p.subs[key] = map[chan Envelope[V]]struct{}{}
+	}
+	p.subs[key][ch] = struct{}{}
+	cancel = func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// CloseAll may have already removed and closed ch (e.g. the server
+		// shut down while this subscriber was still connected); closing it
+		// again here would panic.
+		if _, ok := p.subs[key][ch]; !ok {
+			return
+		}
+		delete(p.subs[key], ch)
+		close(ch)
+	}
+	return
+}
+
+// Count reports the number of currently active subscribers for key.
+func (p *PubSub[K, V]) Count(key K) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.subs[key])
+}
+
+// Since returns every backlogged event for key with a sequence number
+// greater than afterSeq, oldest first.
+func (p *PubSub[K, V]) Since(key K, afterSeq uint64) []Envelope[V] {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []Envelope[V]
+	for _, env := range p.backlog[key] {
+		if env.Seq > afterSeq {
+			out = append(out, env)
+		}
+	}
+	return out
+}
+
+// CloseAll closes every currently subscribed channel and forgets them. Used
+// on graceful shutdown so subscribers (e.g. WebSocket connections) observe a
+// clean close instead of being cut off once the listener stops accepting.
+func (p *PubSub[K, V]) CloseAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, subs := range p.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(p.subs, key)
+	}
+}
+
+func (p *PubSub[K, V]) Publish(key K, v V) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq[key]++
+	env := Envelope[V]{Seq: p.seq[key], Value: v}
+
+	buf := append(p.backlog[key], env)
+	if len(buf) > p.backlogCap {
+		buf = buf[len(buf)-p.backlogCap:]
+	}
+	p.backlog[key] = buf
+
+	for ch := range p.subs[key] {
+		select {
+		case ch <- env:
+		default:
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+// TestPubSubSinceReplaysOnlyNewerEvents exercises the backlog replay a
+// reconnecting /api/ws client relies on: Since(key, lastSeq) must return
+// only what the client hasn't already seen, in order.
+func TestPubSubSinceReplaysOnlyNewerEvents(t *testing.T) {
+	p := NewPubSub[string, int](eventBacklogSize)
+	for i := 1; i <= 5; i++ {
+		p.Publish("k", i)
+	}
+
+	got := p.Since("k", 3)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events after seq 3, got %d: %+v", len(got), got)
+	}
+	if got[0].Value != 4 || got[1].Value != 5 {
+		t.Fatalf("expected [4, 5] in order, got %+v", got)
+	}
+
+	if got := p.Since("k", 5); len(got) != 0 {
+		t.Fatalf("expected no events once the client has seen everything, got %+v", got)
+	}
+}
+
+// TestPubSubBacklogCapEvictsOldest confirms a client that reconnects after
+// missing more than backlogCap events gets the most recent ones, not an
+// unbounded replay.
+func TestPubSubBacklogCapEvictsOldest(t *testing.T) {
+	const backlogCap = 4
+	p := NewPubSub[string, int](backlogCap)
+	for i := 1; i <= backlogCap*3; i++ {
+		p.Publish("k", i)
+	}
+
+	got := p.Since("k", 0)
+	if len(got) != backlogCap {
+		t.Fatalf("expected backlog capped at %d, got %d", backlogCap, len(got))
+	}
+	if first, last := got[0].Value, got[len(got)-1].Value; first != backlogCap*3-backlogCap+1 || last != backlogCap*3 {
+		t.Fatalf("expected the newest %d events, got range [%d, %d]", backlogCap, first, last)
+	}
+}
+
+// TestPubSubCloseAllClosesSubscribers confirms graceful shutdown (repo.Shutdown)
+// closes every open subscriber channel rather than leaking them.
+func TestPubSubCloseAllClosesSubscribers(t *testing.T) {
+	p := NewPubSub[string, int](eventBacklogSize)
+	ch, cancel := p.Subscribe("k")
+	defer cancel()
+
+	p.CloseAll()
+
+	if _, ok := <-ch; ok {
+		t.Fatalf("expected channel to be closed after CloseAll")
+	}
+	if n := p.Count("k"); n != 0 {
+		t.Fatalf("expected 0 subscribers after CloseAll, got %d", n)
+	}
+}
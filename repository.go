@@ -0,0 +1,43 @@
+package main
+
+import "time"
+
+// Repository is the storage interface the HTTP handlers depend on. Handlers
+// never reach into a concrete backend's fields, so the backend can be
+// swapped (see newRepository) without touching routing code.
+type Repository interface {
+	Login(role, login, pass string) (LoginResp, error)
+
+	GetPatient(id int) (Patient, bool)
+	GetDoctor(id int) (Doctor, bool)
+	ListDoctors() []Doctor
+	SelectDoctor(patientID, doctorID int) error
+	SelectedDoctor(patientID int) (Doctor, bool)
+	PatientsOfDoctor(doctorID int) []Patient
+	SubscribeUser(role string, id int) (ch chan Envelope[Event], cancel func())
+	// RecentEvents returns backlogged events for (role, id) with a sequence
+	// number greater than afterSeq, letting a reconnecting /api/ws client
+	// catch up on whatever it missed (the WebSocket analogue of SSE's
+	// Last-Event-ID).
+	RecentEvents(role string, id int, afterSeq uint64) []Envelope[Event]
+	// SubscriberCount reports how many /api/ws connections are currently
+	// open for (role, id), used to enforce a per-user subscriber cap.
+	SubscriberCount(role string, id int) int
+	// Shutdown closes every subscriber channel so open /api/ws connections
+	// disconnect cleanly instead of being cut off by the server listener.
+	Shutdown()
+
+	SetSchedule(doctorID int, sched DoctorSchedule) error
+	FreeSlots(doctorID int, from, to time.Time) ([]TimeSlot, error)
+	BookAppointment(patientID, doctorID int, start, end time.Time, reason string) (Appointment, error)
+	// CancelAppointment and RescheduleAppointment require callerRole/callerID
+	// to match one side of the appointment (see appointmentOwnedBy), so only
+	// the appointment's own patient or doctor can mutate it.
+	CancelAppointment(callerRole string, callerID, id int) (Appointment, error)
+	RescheduleAppointment(callerRole string, callerID, id int, start, end time.Time) (Appointment, error)
+	AppointmentsOfPatient(patientID int) []Appointment
+
+	SendMessage(fromRole string, fromID int, toRole string, toID int, body string) (Message, error)
+	MessagesWith(role string, id, peerID int, since time.Time) ([]Message, error)
+	UnreadCount(role string, id int) int
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newConformanceRepos boots a MemoryRepository and a SQLRepository from the
+// same seed data, so the two backends can be driven through an identical
+// sequence of calls and asserted to agree.
+func newConformanceRepos(t *testing.T) (Repository, Repository) {
+	t.Helper()
+	dir := t.TempDir()
+	seed := Seed{
+		Patients: []Patient{{ID: 1, Login: "pat", Name: "Pat Patient"}},
+		Doctors:  []Doctor{{ID: 1, Login: "doc", Last: "Doc"}},
+	}
+	b, err := json.Marshal(seed)
+	if err != nil {
+		t.Fatalf("marshal seed: %v", err)
+	}
+	seedPath := filepath.Join(dir, "seed.json")
+	if err := os.WriteFile(seedPath, b, 0644); err != nil {
+		t.Fatalf("write seed: %v", err)
+	}
+
+	mem, err := NewMemoryRepository(seedPath)
+	if err != nil {
+		t.Fatalf("NewMemoryRepository: %v", err)
+	}
+	t.Cleanup(mem.Shutdown)
+	sql, err := NewSQLRepository(filepath.Join(dir, "db.sqlite"), seedPath)
+	if err != nil {
+		t.Fatalf("NewSQLRepository: %v", err)
+	}
+	t.Cleanup(sql.Shutdown)
+	return mem, sql
+}
+
+// TestRepositoryConformance drives both backends through the same
+// schedule/book/conflict/reschedule/cancel sequence and asserts they reach
+// the same observable outcomes, since handlers depend on Repository alone
+// and must not notice which backend is behind it.
+func TestRepositoryConformance(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			mem, sql := newConformanceRepos(t)
+			repo := mem
+			if backend == "sqlite" {
+				repo = sql
+			}
+
+			monday := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+			if monday.Weekday() != time.Monday {
+				t.Fatalf("test setup: 2026-01-05 is not a Monday")
+			}
+			if err := repo.SetSchedule(1, DoctorSchedule{
+				SlotMinutes: 30,
+				Weekly:      []WeeklyAvailability{{Weekday: time.Monday, StartMin: 9 * 60, EndMin: 17 * 60}},
+			}); err != nil {
+				t.Fatalf("SetSchedule: %v", err)
+			}
+
+			outside := monday.Add(3 * time.Hour)
+			if _, err := repo.BookAppointment(1, 1, outside, outside.Add(30*time.Minute), "x"); err == nil {
+				t.Fatalf("expected booking outside schedule to fail")
+			}
+
+			within := monday.Add(9 * time.Hour)
+			appt, err := repo.BookAppointment(1, 1, within, within.Add(30*time.Minute), "checkup")
+			if err != nil {
+				t.Fatalf("BookAppointment: %v", err)
+			}
+
+			if _, err := repo.BookAppointment(1, 1, within, within.Add(30*time.Minute), "dup"); err == nil {
+				t.Fatalf("expected a conflicting booking to fail")
+			}
+
+			if _, err := repo.RescheduleAppointment("doctor", 99, appt.ID, within, within.Add(30*time.Minute)); err != ErrForbidden {
+				t.Fatalf("expected ErrForbidden for a non-owning caller, got %v", err)
+			}
+
+			rescheduled := monday.Add(10 * time.Hour)
+			appt, err = repo.RescheduleAppointment("patient", 1, appt.ID, rescheduled, rescheduled.Add(30*time.Minute))
+			if err != nil {
+				t.Fatalf("RescheduleAppointment: %v", err)
+			}
+			if !appt.Start.Equal(rescheduled) {
+				t.Fatalf("expected rescheduled start %v, got %v", rescheduled, appt.Start)
+			}
+
+			if _, err := repo.CancelAppointment("patient", 1, appt.ID); err != nil {
+				t.Fatalf("CancelAppointment: %v", err)
+			}
+
+			got := repo.AppointmentsOfPatient(1)
+			if len(got) != 1 || got[0].Status != AppointmentCancelled {
+				t.Fatalf("expected one cancelled appointment, got %+v", got)
+			}
+		})
+	}
+}
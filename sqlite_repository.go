@@ -0,0 +1,498 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// SQLRepository is a Repository backed by SQLite via GORM. Booking and
+// rescheduling are additionally serialized through mu, mirroring the
+// conflict-detection-under-mutex pattern MemoryRepository uses, since
+// SQLite only ever allows a single writer anyway.
+type SQLRepository struct {
+	db     *gorm.DB
+	pubsub *PubSub[userKey, Event]
+	mu     sync.Mutex
+}
+
+// scheduleRow is the DoctorSchedule's on-disk row; its nested slices are
+// stored as JSON columns since GORM has no native support for them.
+type scheduleRow struct {
+	DoctorID    int `gorm:"primaryKey"`
+	SlotMinutes int
+	Weekly      jsonColumn[[]WeeklyAvailability]
+	Exceptions  jsonColumn[[]AvailabilityException]
+}
+
+func (scheduleRow) TableName() string { return "doctor_schedules" }
+
+// jsonColumn adapts any JSON-marshalable value into a single GORM/database column.
+type jsonColumn[T any] struct {
+	Data T
+}
+
+func (j jsonColumn[T]) Value() (driver.Value, error) {
+	b, err := json.Marshal(j.Data)
+	return string(b), err
+}
+
+func (j *jsonColumn[T]) Scan(v any) error {
+	var b []byte
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		b = x
+	case string:
+		b = []byte(x)
+	default:
+		return fmt.Errorf("jsonColumn: unsupported scan type %T", v)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, &j.Data)
+}
+
+func NewSQLRepository(dsn, seedPath string) (*SQLRepository, error) {
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.SetMaxOpenConns(1) // sqlite supports one writer at a time
+	}
+	if err := db.AutoMigrate(&Patient{}, &Doctor{}, &Selection{}, &Appointment{}, &scheduleRow{}, &Message{}); err != nil {
+		return nil, fmt.Errorf("automigrate: %w", err)
+	}
+	repo := &SQLRepository{db: db, pubsub: NewPubSub[userKey, Event](eventBacklogSize)}
+	if err := repo.importSeedIfEmpty(seedPath); err != nil {
+		return nil, fmt.Errorf("import seed: %w", err)
+	}
+	return repo, nil
+}
+
+// importSeedIfEmpty runs once on first boot: if the patients table is empty
+// it loads data/seed.json the same way MemoryRepository does.
+func (r *SQLRepository) importSeedIfEmpty(seedPath string) error {
+	var count int64
+	if err := r.db.Model(&Patient{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	b, err := os.ReadFile(seedPath)
+	if err != nil {
+		return err
+	}
+	var seed Seed
+	if err := json.Unmarshal(b, &seed); err != nil {
+		return err
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		for _, p := range seed.Patients {
+			if err := tx.Create(&p).Error; err != nil {
+				return err
+			}
+		}
+		for _, d := range seed.Doctors {
+			if err := tx.Create(&d).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *SQLRepository) Login(role, login, pass string) (LoginResp, error) {
+	switch role {
+	case "patient":
+		var p Patient
+		if err := r.db.Where("login = ?", login).First(&p).Error; err != nil {
+			return LoginResp{}, errors.New("invalid credentials")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(p.Password), []byte(pass)) != nil {
+			return LoginResp{}, errors.New("invalid credentials")
+		}
+		return LoginResp{Role: "patient", ID: p.ID, Name: p.Name}, nil
+	case "doctor":
+		var d Doctor
+		if err := r.db.Where("login = ?", login).First(&d).Error; err != nil {
+			return LoginResp{}, errors.New("invalid credentials")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(d.Password), []byte(pass)) != nil {
+			return LoginResp{}, errors.New("invalid credentials")
+		}
+		return LoginResp{Role: "doctor", ID: d.ID, Name: strings.TrimSpace(d.Last + " " + d.First + " " + d.Middle)}, nil
+	default:
+		return LoginResp{}, errors.New("invalid credentials")
+	}
+}
+
+func (r *SQLRepository) GetPatient(id int) (Patient, bool) {
+	var p Patient
+	if err := r.db.First(&p, id).Error; err != nil {
+		return Patient{}, false
+	}
+	return p, true
+}
+
+func (r *SQLRepository) GetDoctor(id int) (Doctor, bool) {
+	var d Doctor
+	if err := r.db.First(&d, id).Error; err != nil {
+		return Doctor{}, false
+	}
+	return d, true
+}
+
+func (r *SQLRepository) ListDoctors() []Doctor {
+	var docs []Doctor
+	r.db.Find(&docs)
+	return docs
+}
+
+func (r *SQLRepository) SelectDoctor(patientID, doctorID int) error {
+	if _, ok := r.GetPatient(patientID); !ok {
+		return errors.New("patient not found")
+	}
+	if _, ok := r.GetDoctor(doctorID); !ok {
+		return errors.New("doctor not found")
+	}
+	sel := Selection{PatientID: patientID, DoctorID: doctorID}
+	if err := r.db.Save(&sel).Error; err != nil {
+		return err
+	}
+	r.pubsub.Publish(userKey{"doctor", doctorID}, Event{Type: EventUpdate})
+	selectionsTotal.Inc()
+	return nil
+}
+
+func (r *SQLRepository) SelectedDoctor(patientID int) (Doctor, bool) {
+	var sel Selection
+	if err := r.db.First(&sel, patientID).Error; err != nil {
+		return Doctor{}, false
+	}
+	return r.GetDoctor(sel.DoctorID)
+}
+
+func (r *SQLRepository) PatientsOfDoctor(doctorID int) []Patient {
+	var sels []Selection
+	r.db.Where("doctor_id = ?", doctorID).Find(&sels)
+	var out []Patient
+	for _, sel := range sels {
+		if p, ok := r.GetPatient(sel.PatientID); ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (r *SQLRepository) SubscribeUser(role string, id int) (ch chan Envelope[Event], cancel func()) {
+	return r.pubsub.Subscribe(userKey{role, id})
+}
+
+func (r *SQLRepository) RecentEvents(role string, id int, afterSeq uint64) []Envelope[Event] {
+	return r.pubsub.Since(userKey{role, id}, afterSeq)
+}
+
+func (r *SQLRepository) SubscriberCount(role string, id int) int {
+	return r.pubsub.Count(userKey{role, id})
+}
+
+func (r *SQLRepository) Shutdown() {
+	r.pubsub.CloseAll()
+}
+
+func (r *SQLRepository) SetSchedule(doctorID int, sched DoctorSchedule) error {
+	if _, ok := r.GetDoctor(doctorID); !ok {
+		return errors.New("doctor not found")
+	}
+	if sched.SlotMinutes <= 0 {
+		sched.SlotMinutes = 30
+	}
+	row := scheduleRow{
+		DoctorID:    doctorID,
+		SlotMinutes: sched.SlotMinutes,
+		Weekly:      jsonColumn[[]WeeklyAvailability]{Data: sched.Weekly},
+		Exceptions:  jsonColumn[[]AvailabilityException]{Data: sched.Exceptions},
+	}
+	return r.db.Save(&row).Error
+}
+
+func (r *SQLRepository) schedule(doctorID int) (DoctorSchedule, bool) {
+	var row scheduleRow
+	if err := r.db.First(&row, doctorID).Error; err != nil {
+		return DoctorSchedule{}, false
+	}
+	return DoctorSchedule{
+		DoctorID:    row.DoctorID,
+		SlotMinutes: row.SlotMinutes,
+		Weekly:      row.Weekly.Data,
+		Exceptions:  row.Exceptions.Data,
+	}, true
+}
+
+func (r *SQLRepository) appointmentsForDoctor(doctorID int) []Appointment {
+	var appts []Appointment
+	r.db.Where("doctor_id = ?", doctorID).Find(&appts)
+	return appts
+}
+
+// scheduleAllows mirrors MemoryRepository.scheduleAllowsLocked: it reports
+// whether [start, end) falls entirely within one of doctorID's available
+// windows for that calendar day, applying exceptions. It does not check for
+// conflicting appointments; callers combine it with hasConflict.
+func (r *SQLRepository) scheduleAllows(doctorID int, start, end time.Time) bool {
+	sched, ok := r.schedule(doctorID)
+	if !ok {
+		return false
+	}
+	day := start.Truncate(24 * time.Hour)
+	var windows []AvailabilityException
+	if ex, ok := findException(sched.Exceptions, day); ok {
+		if !ex.Available {
+			return false
+		}
+		windows = append(windows, ex)
+	} else {
+		for _, w := range sched.Weekly {
+			if w.Weekday == day.Weekday() {
+				windows = append(windows, AvailabilityException{StartMin: w.StartMin, EndMin: w.EndMin})
+			}
+		}
+	}
+	for _, w := range windows {
+		winStart := day.Add(time.Duration(w.StartMin) * time.Minute)
+		winEnd := day.Add(time.Duration(w.EndMin) * time.Minute)
+		if !start.Before(winStart) && !end.After(winEnd) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasConflict reports whether doctorID already has a non-cancelled
+// appointment overlapping [start, end), ignoring excludeID (used on reschedule).
+func (r *SQLRepository) hasConflict(doctorID int, start, end time.Time, excludeID int) bool {
+	for _, a := range r.appointmentsForDoctor(doctorID) {
+		if a.ID == excludeID || a.Status == AppointmentCancelled {
+			continue
+		}
+		if start.Before(a.End) && a.Start.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// FreeSlots mirrors MemoryRepository.FreeSlots, walking the weekly pattern
+// and exceptions and subtracting booked appointments.
+func (r *SQLRepository) FreeSlots(doctorID int, from, to time.Time) ([]TimeSlot, error) {
+	if _, ok := r.GetDoctor(doctorID); !ok {
+		return nil, errors.New("doctor not found")
+	}
+	sched, ok := r.schedule(doctorID)
+	if !ok {
+		return nil, nil
+	}
+	exceptions := map[string]AvailabilityException{}
+	for _, e := range sched.Exceptions {
+		exceptions[e.Date] = e
+	}
+
+	var slots []TimeSlot
+	for day := from.Truncate(24 * time.Hour); day.Before(to); day = day.AddDate(0, 0, 1) {
+		dateKey := day.Format("2006-01-02")
+		var windows []AvailabilityException
+		if ex, ok := exceptions[dateKey]; ok {
+			if !ex.Available {
+				continue
+			}
+			windows = append(windows, ex)
+		} else {
+			for _, w := range sched.Weekly {
+				if w.Weekday == day.Weekday() {
+					windows = append(windows, AvailabilityException{StartMin: w.StartMin, EndMin: w.EndMin})
+				}
+			}
+		}
+		for _, w := range windows {
+			slotStart := day.Add(time.Duration(w.StartMin) * time.Minute)
+			windowEnd := day.Add(time.Duration(w.EndMin) * time.Minute)
+			step := time.Duration(sched.SlotMinutes) * time.Minute
+			for slotStart.Add(step).Compare(windowEnd) <= 0 {
+				slotEnd := slotStart.Add(step)
+				if !slotStart.Before(from) && !slotEnd.After(to) && !r.hasConflict(doctorID, slotStart, slotEnd, 0) {
+					slots = append(slots, TimeSlot{DoctorID: doctorID, Start: slotStart, End: slotEnd})
+				}
+				slotStart = slotEnd
+			}
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Start.Before(slots[j].Start) })
+	return slots, nil
+}
+
+func (r *SQLRepository) BookAppointment(patientID, doctorID int, start, end time.Time, reason string) (Appointment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.GetPatient(patientID); !ok {
+		return Appointment{}, errors.New("patient not found")
+	}
+	if _, ok := r.GetDoctor(doctorID); !ok {
+		return Appointment{}, errors.New("doctor not found")
+	}
+	if !end.After(start) {
+		return Appointment{}, errors.New("end must be after start")
+	}
+	if !r.scheduleAllows(doctorID, start, end) {
+		return Appointment{}, errors.New("requested time is outside doctor's availability")
+	}
+	if r.hasConflict(doctorID, start, end, 0) {
+		return Appointment{}, errors.New("slot no longer available")
+	}
+	appt := Appointment{
+		PatientID: patientID,
+		DoctorID:  doctorID,
+		Start:     start,
+		End:       end,
+		Status:    AppointmentPending,
+		Reason:    reason,
+	}
+	if err := r.db.Create(&appt).Error; err != nil {
+		return Appointment{}, err
+	}
+	r.notifyAppointment(patientID, doctorID)
+	return appt, nil
+}
+
+func (r *SQLRepository) CancelAppointment(callerRole string, callerID, id int) (Appointment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var appt Appointment
+	if err := r.db.First(&appt, id).Error; err != nil {
+		return Appointment{}, errors.New("appointment not found")
+	}
+	if !appointmentOwnedBy(appt, callerRole, callerID) {
+		return Appointment{}, ErrForbidden
+	}
+	appt.Status = AppointmentCancelled
+	if err := r.db.Save(&appt).Error; err != nil {
+		return Appointment{}, err
+	}
+	r.notifyAppointment(appt.PatientID, appt.DoctorID)
+	return appt, nil
+}
+
+func (r *SQLRepository) RescheduleAppointment(callerRole string, callerID, id int, start, end time.Time) (Appointment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var appt Appointment
+	if err := r.db.First(&appt, id).Error; err != nil {
+		return Appointment{}, errors.New("appointment not found")
+	}
+	if !appointmentOwnedBy(appt, callerRole, callerID) {
+		return Appointment{}, ErrForbidden
+	}
+	if appt.Status == AppointmentCancelled {
+		return Appointment{}, errors.New("appointment is cancelled")
+	}
+	if !end.After(start) {
+		return Appointment{}, errors.New("end must be after start")
+	}
+	if !r.scheduleAllows(appt.DoctorID, start, end) {
+		return Appointment{}, errors.New("requested time is outside doctor's availability")
+	}
+	if r.hasConflict(appt.DoctorID, start, end, appt.ID) {
+		return Appointment{}, errors.New("slot no longer available")
+	}
+	appt.Start = start
+	appt.End = end
+	appt.Status = AppointmentPending
+	if err := r.db.Save(&appt).Error; err != nil {
+		return Appointment{}, err
+	}
+	r.notifyAppointment(appt.PatientID, appt.DoctorID)
+	return appt, nil
+}
+
+// notifyAppointment pushes an "update" event to both sides of an
+// appointment so either party's open WebSocket refetches.
+func (r *SQLRepository) notifyAppointment(patientID, doctorID int) {
+	r.pubsub.Publish(userKey{"patient", patientID}, Event{Type: EventUpdate})
+	r.pubsub.Publish(userKey{"doctor", doctorID}, Event{Type: EventUpdate})
+}
+
+func (r *SQLRepository) AppointmentsOfPatient(patientID int) []Appointment {
+	var out []Appointment
+	r.db.Where("patient_id = ?", patientID).Order("start").Find(&out)
+	return out
+}
+
+func (r *SQLRepository) SendMessage(fromRole string, fromID int, toRole string, toID int, body string) (Message, error) {
+	wantToRole, err := peerRole(fromRole)
+	if err != nil {
+		return Message{}, err
+	}
+	if toRole != wantToRole {
+		return Message{}, errors.New("to_role does not match from_role")
+	}
+	if err := authorizeMessage(r, fromRole, fromID, toID); err != nil {
+		return Message{}, err
+	}
+
+	msg := Message{
+		FromRole:  fromRole,
+		FromID:    fromID,
+		ToRole:    toRole,
+		ToID:      toID,
+		Body:      body,
+		CreatedAt: time.Now(),
+	}
+	if err := r.db.Create(&msg).Error; err != nil {
+		return Message{}, err
+	}
+	r.pubsub.Publish(userKey{toRole, toID}, Event{Type: EventMessage, Message: &msg})
+	return msg, nil
+}
+
+func (r *SQLRepository) MessagesWith(role string, id, peerID int, since time.Time) ([]Message, error) {
+	wantPeerRole, err := peerRole(role)
+	if err != nil {
+		return nil, err
+	}
+	var out []Message
+	r.db.Where(
+		"((from_role = ? AND from_id = ? AND to_role = ? AND to_id = ?) OR (to_role = ? AND to_id = ? AND from_role = ? AND from_id = ?)) AND created_at > ?",
+		role, id, wantPeerRole, peerID,
+		role, id, wantPeerRole, peerID,
+		since,
+	).Order("created_at").Find(&out)
+
+	now := time.Now()
+	for i := range out {
+		if out[i].ToRole == role && out[i].ToID == id && out[i].ReadAt == nil {
+			out[i].ReadAt = &now
+			r.db.Save(&out[i])
+		}
+	}
+	return out, nil
+}
+
+func (r *SQLRepository) UnreadCount(role string, id int) int {
+	var count int64
+	r.db.Model(&Message{}).Where("to_role = ? AND to_id = ? AND read_at IS NULL", role, id).Count(&count)
+	return int(count)
+}
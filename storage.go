@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// newRepository builds the Repository backend selected by the STORAGE
+// environment variable: "memory" (the default) or "sqlite", the latter
+// requiring DATABASE_URL to point at a database file/DSN.
+func newRepository(seedPath string) (Repository, error) {
+	switch backend := getenv("STORAGE", "memory"); backend {
+	case "memory":
+		return NewMemoryRepository(seedPath)
+	case "sqlite":
+		dsn := getenv("DATABASE_URL", "")
+		if dsn == "" {
+			return nil, fmt.Errorf("DATABASE_URL is required when STORAGE=sqlite")
+		}
+		return NewSQLRepository(dsn, seedPath)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE backend %q", backend)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newTestMemoryRepository writes a minimal seed.json under a temp dir and
+// boots a real MemoryRepository from it, so the persistence worker and its
+// file writes are exercised exactly as they are in production.
+func newTestMemoryRepository(t *testing.T) *MemoryRepository {
+	t.Helper()
+	dir := t.TempDir()
+	seed := Seed{
+		Patients: []Patient{{ID: 1, Login: "pat"}},
+		Doctors:  []Doctor{{ID: 1, Login: "doc"}, {ID: 2, Login: "doc2"}},
+	}
+	b, err := json.Marshal(seed)
+	if err != nil {
+		t.Fatalf("marshal seed: %v", err)
+	}
+	seedPath := filepath.Join(dir, "seed.json")
+	if err := os.WriteFile(seedPath, b, 0644); err != nil {
+		t.Fatalf("write seed: %v", err)
+	}
+	repo, err := NewMemoryRepository(seedPath)
+	if err != nil {
+		t.Fatalf("NewMemoryRepository: %v", err)
+	}
+	t.Cleanup(repo.Shutdown)
+	return repo
+}
+
+// TestConcurrentSelectDoctorDoesNotRace drives many concurrent selections
+// (previously each spawned its own "go s.persistSelections()" goroutine,
+// letting two writers race on the same file) through runPersistenceWorker
+// and expects `go test -race` to find nothing.
+func TestConcurrentSelectDoctorDoesNotRace(t *testing.T) {
+	repo := newTestMemoryRepository(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		doctorID := 1 + i%2
+		go func(doctorID int) {
+			defer wg.Done()
+			if err := repo.SelectDoctor(1, doctorID); err != nil {
+				t.Errorf("SelectDoctor: %v", err)
+			}
+		}(doctorID)
+	}
+	wg.Wait()
+}